@@ -0,0 +1,60 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import "sync"
+
+// DefaultBatchWorkers is the number of requests BatchOperation will build
+// concurrently when no other limit has been configured.
+const DefaultBatchWorkers = 8
+
+// BatchWorkers bounds how many requests BatchOperation builds concurrently.
+// It's a package-level knob, in keeping with the other pluggable pieces of
+// this package (see SetPersistedQueryStore, RegisterValidationRule), so a
+// deployment can size it to its query-validation cost without threading a
+// limit through every call site.
+var BatchWorkers = DefaultBatchWorkers
+
+// BatchOperation builds the Operation for every request in reqs, running up
+// to BatchWorkers of them concurrently. It mirrors Operation(), except that
+// an error parsing or validating one request doesn't stop the others:
+// ops[i]/errs[i] hold the result for reqs[i], so a caller executing a
+// batched HTTP request can still answer every request that was valid.
+func (s *schema) BatchOperation(reqs []*Request) ([]Operation, []error) {
+	ops := make([]Operation, len(reqs))
+	errs := make([]error, len(reqs))
+
+	workers := BatchWorkers
+	if workers <= 0 {
+		workers = DefaultBatchWorkers
+	}
+	sem := make(chan struct{}, workers)
+
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+	for i, req := range reqs {
+		sem <- struct{}{}
+		go func(i int, req *Request) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			ops[i], errs[i] = s.Operation(req)
+		}(i, req)
+	}
+	wg.Wait()
+
+	return ops, errs
+}
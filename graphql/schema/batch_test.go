@@ -0,0 +1,104 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func batchTestSchema() *schema {
+	return &schema{schema: complexityTestSchema}
+}
+
+func TestBatchOperationIsolatesErrors(t *testing.T) {
+	s := batchTestSchema()
+	reqs := []*Request{
+		{Query: `{ users { name } }`},
+		{Query: `{ users( `}, // malformed: should fail independently
+		{Query: `{ users { name } }`},
+	}
+
+	ops, errs := s.BatchOperation(reqs)
+
+	require.Len(t, ops, 3)
+	require.Len(t, errs, 3)
+
+	require.NoError(t, errs[0])
+	require.NotNil(t, ops[0])
+
+	require.Error(t, errs[1])
+	require.Nil(t, ops[1])
+
+	require.NoError(t, errs[2])
+	require.NotNil(t, ops[2])
+}
+
+func TestBatchOperationPreservesRequestOrder(t *testing.T) {
+	s := batchTestSchema()
+	reqs := make([]*Request, 20)
+	for i := range reqs {
+		reqs[i] = &Request{Query: `{ users { name } }`}
+	}
+	// Every request but reqs[10] is identical and valid; BatchOperation has to line
+	// ops[i]/errs[i] up with reqs[i] even though workers race to finish.
+	reqs[10] = &Request{Query: `{ missingField`}
+
+	ops, errs := s.BatchOperation(reqs)
+
+	for i := range reqs {
+		if i == 10 {
+			require.Error(t, errs[i], "index %d", i)
+			require.Nil(t, ops[i], "index %d", i)
+			continue
+		}
+		require.NoError(t, errs[i], "index %d", i)
+		require.NotNil(t, ops[i], "index %d", i)
+	}
+}
+
+func TestHandleSingleRequestIsNotABatch(t *testing.T) {
+	s := batchTestSchema()
+	ops, errs, batch, err := s.Handle([]byte(`{"query": "{ users { name } }"}`))
+
+	require.NoError(t, err)
+	require.False(t, batch)
+	require.Len(t, ops, 1)
+	require.Len(t, errs, 1)
+	require.NoError(t, errs[0])
+}
+
+func TestHandleBatchPreservesOrderAndIsolatesErrors(t *testing.T) {
+	s := batchTestSchema()
+	body := `[
+		{"query": "{ users { name } }"},
+		{"query": "{ users( "},
+		{"query": "{ users { name } }"}
+	]`
+
+	ops, errs, batch, err := s.Handle([]byte(body))
+
+	require.NoError(t, err)
+	require.True(t, batch)
+	require.Len(t, ops, 3)
+	require.Len(t, errs, 3)
+
+	require.NoError(t, errs[0])
+	require.Error(t, errs[1])
+	require.NoError(t, errs[2])
+}
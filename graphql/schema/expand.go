@@ -0,0 +1,166 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"github.com/pkg/errors"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+const (
+	// DefaultMaxSelectionDepth caps how many levels of nested selection
+	// sets fragment expansion will walk.
+	DefaultMaxSelectionDepth = 50
+	// DefaultMaxSelections caps the total number of selections expansion
+	// will produce across a whole operation.
+	DefaultMaxSelections = 100000
+)
+
+// MaxSelectionDepth and MaxSelections bound fragment expansion so an
+// adversarial query with deeply nested fragments on interfaces/unions can't
+// force unbounded work onto the server. They're package-level, in keeping
+// with the other pluggable limits here (see WithComplexityLimit), so a
+// deployment can tune them without recompiling. A query that breaches
+// either is rejected with a GraphQL error before it reaches a resolver.
+var (
+	MaxSelectionDepth = DefaultMaxSelectionDepth
+	MaxSelections     = DefaultMaxSelections
+)
+
+// collectKey memoizes a collectFields call by the type condition it ran
+// under and the field whose selection set it ran over, so that a field
+// reached more than once (e.g. from a fragment spread in several places)
+// isn't re-collected each time it's reached. memo holds the field pointer
+// itself, so a key can't be taken over by another field during expansion.
+type collectKey struct {
+	typeName string
+	field    *ast.Field
+}
+
+// expansionWork is one entry on expandFragments' worklist: a field whose
+// selection set still needs its fragments expanded, at the given depth and
+// response path (the path to field itself).
+type expansionWork struct {
+	field *ast.Field
+	depth int
+	path  []string
+}
+
+// expandFragments replaces a fragment's selection set with its fields
+// directly inside the referencing field's selection set, for every field
+// reachable from op's top-level selection set. It used to do this by
+// recursing into each field's children; that blows the stack on adversarial
+// queries with deeply nested fragments, so this walks an explicit worklist
+// instead, hard-capping both depth and the total number of selections
+// produced via MaxSelectionDepth/MaxSelections.
+//
+// Fragments tagged @defer and fields tagged @stream are pulled out of the
+// primary selection set rather than expanded, and returned so the caller
+// can schedule them as follow-up incremental-delivery patches.
+func expandFragments(op *operation) ([]*IncrementalSelection, error) {
+	memo := make(map[collectKey][]*ast.Field)
+
+	var incremental []*IncrementalSelection
+	total := 0
+
+	queue := make([]expansionWork, 0, len(op.op.SelectionSet))
+	for _, sel := range op.op.SelectionSet {
+		field := sel.(*ast.Field)
+		queue = append(queue, expansionWork{field: field, depth: 1, path: childPath(nil, field)})
+	}
+
+	for len(queue) > 0 {
+		w := queue[0]
+		queue = queue[1:]
+
+		if w.depth > MaxSelectionDepth {
+			return nil, errors.Errorf(
+				"selection set exceeds the maximum nesting depth of %d", MaxSelectionDepth)
+		}
+
+		// find all valid type names that this field satisfies
+		typeName := w.field.Definition.Type.Name()
+		satisfies := []string{typeName}
+		var additionalTypes []*ast.Definition
+		switch op.inSchema.schema.Types[typeName].Kind {
+		case ast.Interface:
+			additionalTypes = op.inSchema.schema.PossibleTypes[typeName]
+		case ast.Union:
+			additionalTypes = op.inSchema.schema.PossibleTypes[typeName]
+		case ast.Object:
+			additionalTypes = op.inSchema.schema.Implements[typeName]
+		default:
+			// fragments can't be present on a field which isn't an
+			// Interface, Union or Object, so there's nothing to expand
+			continue
+		}
+		for _, typ := range additionalTypes {
+			satisfies = append(satisfies, typ.Name)
+		}
+
+		primarySet, deferred := splitDeferred(w.field.SelectionSet, w.path)
+		incremental = append(incremental, deferred...)
+
+		children := collectChildFields(op, w.field, primarySet, satisfies, memo)
+		total += len(children)
+		if total > MaxSelections {
+			return nil, errors.Errorf(
+				"operation expands to more than the maximum of %d selections", MaxSelections)
+		}
+
+		kept := make([]ast.Selection, 0, len(children))
+		for _, child := range children {
+			path := childPath(w.path, child)
+			if stream := streamedSelection(child, path); stream != nil {
+				incremental = append(incremental, stream)
+				continue
+			}
+			kept = append(kept, child)
+			queue = append(queue, expansionWork{field: child, depth: w.depth + 1, path: path})
+		}
+		w.field.SelectionSet = kept
+	}
+
+	return incremental, nil
+}
+
+// collectChildFields collects the concrete fields set's fragments expand to
+// for field, which satisfies satisfies, memoizing the result in memo so that
+// a field reached more than once is only collected once.
+func collectChildFields(
+	op *operation, field *ast.Field, set ast.SelectionSet, satisfies []string,
+	memo map[collectKey][]*ast.Field,
+) []*ast.Field {
+	key := collectKey{typeName: satisfies[0], field: field}
+	if cached, ok := memo[key]; ok {
+		return cached
+	}
+
+	collected := collectFields(&requestContext{
+		RawQuery:  op.query,
+		Variables: op.vars,
+		Doc:       op.doc,
+	}, set, satisfies)
+
+	fields := make([]*ast.Field, 0, len(collected))
+	for _, cf := range collected {
+		fields = append(fields, cf.Field)
+	}
+
+	memo[key] = fields
+	return fields
+}
@@ -0,0 +1,141 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+var expandTestSchema = gqlparser.MustLoadSchema(&ast.Source{Input: `
+	interface Node {
+		id: ID!
+	}
+
+	type User implements Node {
+		id: ID!
+		name: String
+		friend: User
+	}
+
+	type Query {
+		node: Node
+		user: User
+	}
+`})
+
+func expandOperation(t *testing.T, query string) Operation {
+	t.Helper()
+	s := &schema{schema: expandTestSchema}
+	op, err := s.Operation(&Request{Query: query})
+	require.NoError(t, err)
+	return op
+}
+
+// responseNames returns the selected field names at the top level of set,
+// the same shape whether they arrived via a fragment or were written
+// directly - that equivalence is what the iterative worklist has to
+// preserve relative to the old recursive expansion.
+func responseNames(set ast.SelectionSet) []string {
+	names := make([]string, 0, len(set))
+	for _, sel := range set {
+		if f, ok := sel.(*ast.Field); ok {
+			names = append(names, f.Name)
+		}
+	}
+	return names
+}
+
+func TestExpandFragmentsEquivalentToDirectSelection(t *testing.T) {
+	direct := expandOperation(t, `{ user { id name } }`)
+	viaFragment := expandOperation(t, `
+		fragment F on User { id name }
+		{ user { ...F } }
+	`)
+	viaInline := expandOperation(t, `
+		{ user { ... on User { id name } } }
+	`)
+
+	directSet := direct.(*operation).op.SelectionSet[0].(*ast.Field).SelectionSet
+	fragmentSet := viaFragment.(*operation).op.SelectionSet[0].(*ast.Field).SelectionSet
+	inlineSet := viaInline.(*operation).op.SelectionSet[0].(*ast.Field).SelectionSet
+
+	require.ElementsMatch(t, responseNames(directSet), responseNames(fragmentSet))
+	require.ElementsMatch(t, responseNames(directSet), responseNames(inlineSet))
+}
+
+func TestExpandFragmentsOnInterface(t *testing.T) {
+	op := expandOperation(t, `
+		fragment F on User { name }
+		{ node { id ...F } }
+	`)
+
+	nodeSet := op.(*operation).op.SelectionSet[0].(*ast.Field).SelectionSet
+	require.ElementsMatch(t, []string{"id", "name"}, responseNames(nodeSet))
+}
+
+func TestExpandFragmentsRespectsMaxSelectionDepth(t *testing.T) {
+	old := MaxSelectionDepth
+	MaxSelectionDepth = 2
+	defer func() { MaxSelectionDepth = old }()
+
+	s := &schema{schema: expandTestSchema}
+	_, err := s.Operation(&Request{
+		Query: `{ user { friend { friend { friend { name } } } } }`,
+	})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "maximum nesting depth")
+}
+
+func TestExpandFragmentsRespectsMaxSelections(t *testing.T) {
+	old := MaxSelections
+	MaxSelections = 1
+	defer func() { MaxSelections = old }()
+
+	s := &schema{schema: expandTestSchema}
+	_, err := s.Operation(&Request{Query: `{ user { id name } }`})
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "maximum of")
+}
+
+func TestExpandFragmentsDoesNotBlowTheStackOnDeepNesting(t *testing.T) {
+	old := MaxSelectionDepth
+	MaxSelectionDepth = 10000
+	defer func() { MaxSelectionDepth = old }()
+
+	query := "{ user "
+	for i := 0; i < 5000; i++ {
+		query += "{ friend "
+	}
+	query += "{ name }"
+	for i := 0; i < 5000; i++ {
+		query += "}"
+	}
+	query += "}"
+
+	// The old recursive implementation blew the goroutine stack on
+	// adversarial queries like this one; the worklist-based version should
+	// either expand it or reject it as too deep, never crash.
+	s := &schema{schema: expandTestSchema}
+	_, err := s.Operation(&Request{Query: query})
+	if err != nil {
+		require.Contains(t, err.Error(), "maximum nesting depth")
+	}
+}
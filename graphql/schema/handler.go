@@ -0,0 +1,72 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// ParseRequests reads body, accepting either a single GraphQL request
+// object or a JSON array of them, as the batching convention widely used by
+// Apollo/graphql-go clients to coalesce many small reads into one round
+// trip. The returned bool reports whether body was a batch, so a caller
+// replying over HTTP knows whether to write back a single object or an
+// array of them.
+func ParseRequests(body []byte) (reqs []*Request, batch bool, err error) {
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) == 0 {
+		return nil, false, errors.New("empty request body")
+	}
+
+	if trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &reqs); err != nil {
+			return nil, true, errors.Wrap(err, "while reading batched GraphQL requests")
+		}
+		return reqs, true, nil
+	}
+
+	var req Request
+	if err := json.Unmarshal(trimmed, &req); err != nil {
+		return nil, false, errors.Wrap(err, "while reading GraphQL request")
+	}
+	return []*Request{&req}, false, nil
+}
+
+// Handle parses body as ParseRequests does and builds the resulting
+// Operation(s) against s, ties together in the one place the HTTP handler
+// is expected to call. ops[i]/errs[i] hold the result for the i'th request
+// in body, in the order it was received, so the caller can write back a
+// single object or a JSON array matching the shape the client sent,
+// regardless of whether any individual request in a batch failed to parse
+// or validate.
+func (s *schema) Handle(body []byte) (ops []Operation, errs []error, batch bool, err error) {
+	reqs, batch, err := ParseRequests(body)
+	if err != nil {
+		return nil, nil, batch, err
+	}
+
+	if !batch {
+		op, opErr := s.Operation(reqs[0])
+		return []Operation{op}, []error{opErr}, false, nil
+	}
+
+	ops, errs = s.BatchOperation(reqs)
+	return ops, errs, true, nil
+}
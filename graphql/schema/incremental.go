@@ -0,0 +1,198 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"sync"
+
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// Directive names understood for incremental delivery.
+const (
+	deferDirective = "defer"
+	streamDirective = "stream"
+)
+
+// incrementalDirectivesOnce tracks, per *ast.Schema, whether
+// ensureIncrementalDirectives has already registered @defer/@stream on it,
+// so concurrent callers (BatchOperation runs s.Operation from up to
+// BatchWorkers goroutines against the same *schema) don't race a
+// read-check-then-write into s.Directives, a plain map.
+var (
+	incrementalDirectivesMu   sync.Mutex
+	incrementalDirectivesDone = map[*ast.Schema]bool{}
+)
+
+// ensureIncrementalDirectives registers @defer/@stream on s if they aren't
+// already declared. gqlparser's validator rejects any directive usage that
+// isn't declared on the schema it validates against, so without this a
+// query actually using @defer/@stream would be rejected by
+// validator.Validate before it ever reaches splitDeferred/streamedSelection.
+// It's idempotent and safe to call concurrently; it does the registration
+// at most once per *ast.Schema.
+func ensureIncrementalDirectives(s *ast.Schema) {
+	incrementalDirectivesMu.Lock()
+	defer incrementalDirectivesMu.Unlock()
+
+	if incrementalDirectivesDone[s] {
+		return
+	}
+
+	if s.Directives == nil {
+		s.Directives = map[string]*ast.DirectiveDefinition{}
+	}
+	if _, ok := s.Directives[deferDirective]; !ok {
+		s.Directives[deferDirective] = &ast.DirectiveDefinition{
+			Name: deferDirective,
+			Arguments: ast.ArgumentDefinitionList{
+				{Name: "label", Type: ast.NamedType("String", nil)},
+				{Name: "if", Type: ast.NamedType("Boolean", nil)},
+			},
+			Locations: []ast.DirectiveLocation{
+				ast.LocationFragmentSpread, ast.LocationInlineFragment,
+			},
+		}
+	}
+	if _, ok := s.Directives[streamDirective]; !ok {
+		s.Directives[streamDirective] = &ast.DirectiveDefinition{
+			Name: streamDirective,
+			Arguments: ast.ArgumentDefinitionList{
+				{Name: "label", Type: ast.NamedType("String", nil)},
+				{Name: "initialCount", Type: ast.NamedType("Int", nil)},
+				{Name: "if", Type: ast.NamedType("Boolean", nil)},
+			},
+			Locations: []ast.DirectiveLocation{ast.LocationField},
+		}
+	}
+
+	incrementalDirectivesDone[s] = true
+}
+
+// IncrementalSelection is a piece of an operation tagged for incremental
+// delivery: either a fragment carrying @defer, or a list field carrying
+// @stream. It's excluded from the operation's primary selection set and
+// resolved in a follow-up execution pass, delivered to the client as a
+// patch keyed by Path, matching the incremental-delivery spec's
+// multipart/mixed response shape.
+type IncrementalSelection struct {
+	Label      string
+	Path       []string
+	Stream     bool
+	Selections ast.SelectionSet
+}
+
+// incrementalOperation decorates an Operation that contains @defer/@stream
+// selections with those selections, pulled out during fragment expansion.
+type incrementalOperation struct {
+	Operation
+	incremental []*IncrementalSelection
+}
+
+// Incremental returns the @defer/@stream selections found in this
+// operation, in the order they were encountered. Each is resolved in its
+// own follow-up pass once the primary payload has been sent.
+func (o *incrementalOperation) Incremental() []*IncrementalSelection {
+	return o.incremental
+}
+
+// withIncremental wraps op in an incrementalOperation if any @defer/@stream
+// selections were found while expanding it, otherwise returns op unchanged.
+func withIncremental(op Operation, incremental []*IncrementalSelection) Operation {
+	if len(incremental) == 0 {
+		return op
+	}
+	return &incrementalOperation{Operation: op, incremental: incremental}
+}
+
+// splitDeferred separates set into the selections that should remain in the
+// primary selection set and the fragment selections tagged @defer, which
+// are pulled out before fragment expansion so they aren't resolved as part
+// of the primary response. path is the response path to the field that set
+// belongs to, i.e. where a deferred fragment's fields get merged back in.
+func splitDeferred(
+	set ast.SelectionSet, path []string,
+) (primary ast.SelectionSet, deferred []*IncrementalSelection) {
+	for _, sel := range set {
+		var directives ast.DirectiveList
+		switch s := sel.(type) {
+		case *ast.FragmentSpread:
+			directives = s.Directives
+		case *ast.InlineFragment:
+			directives = s.Directives
+		default:
+			primary = append(primary, sel)
+			continue
+		}
+
+		d := directives.ForName(deferDirective)
+		if d == nil {
+			primary = append(primary, sel)
+			continue
+		}
+
+		deferred = append(deferred, &IncrementalSelection{
+			Label:      deferLabel(d),
+			Path:       path,
+			Selections: ast.SelectionSet{sel},
+		})
+	}
+	return primary, deferred
+}
+
+// streamedSelection returns an IncrementalSelection for field if it carries
+// a @stream directive, or nil otherwise. path is the response path to
+// field itself, where its streamed items are appended as they arrive.
+func streamedSelection(field *ast.Field, path []string) *IncrementalSelection {
+	d := field.Directives.ForName(streamDirective)
+	if d == nil {
+		return nil
+	}
+	return &IncrementalSelection{
+		Label:      deferLabel(d),
+		Path:       path,
+		Stream:     true,
+		Selections: ast.SelectionSet{field},
+	}
+}
+
+// childPath returns the response path to child, given the path to its
+// parent field. It never mutates parent.
+func childPath(parent []string, child *ast.Field) []string {
+	key := child.Alias
+	if key == "" {
+		key = child.Name
+	}
+	path := make([]string, len(parent), len(parent)+1)
+	copy(path, parent)
+	return append(path, key)
+}
+
+// deferLabel reads the optional `label` argument off a @defer/@stream
+// directive, used by clients to tell patches apart.
+func deferLabel(d *ast.Directive) string {
+	arg := d.Arguments.ForName("label")
+	if arg == nil {
+		return ""
+	}
+	val, err := arg.Value.Value(nil)
+	if err != nil {
+		return ""
+	}
+	label, _ := val.(string)
+	return label
+}
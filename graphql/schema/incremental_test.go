@@ -0,0 +1,55 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+)
+
+// TestEnsureIncrementalDirectivesConcurrent guards against the concurrent
+// map write BatchOperation can trigger: every goroutine here races against
+// a schema that has never had ensureIncrementalDirectives run on it before,
+// the same condition the first batch of concurrent requests against a
+// freshly loaded schema hits in production. Run with -race.
+func TestEnsureIncrementalDirectivesConcurrent(t *testing.T) {
+	freshSchema := gqlparser.MustLoadSchema(&ast.Source{Input: `
+		type Query {
+			users: [User]
+		}
+		type User {
+			name: String
+		}
+	`})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ensureIncrementalDirectives(freshSchema)
+		}()
+	}
+	wg.Wait()
+
+	require.NotNil(t, freshSchema.Directives[deferDirective])
+	require.NotNil(t, freshSchema.Directives[streamDirective])
+}
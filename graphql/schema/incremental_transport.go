@@ -0,0 +1,89 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+
+	"github.com/pkg/errors"
+)
+
+// incrementalBoundary separates each part of an incremental-delivery
+// response, per the multipart/mixed wire format the spec requires.
+const incrementalBoundary = "graphql"
+
+// IncrementalPatch is one resolved @defer/@stream result, ready to be sent
+// to the client as a multipart/mixed part once its Selections have been
+// executed.
+type IncrementalPatch struct {
+	Label string          `json:"label,omitempty"`
+	Path  []string        `json:"path"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// WriteIncrementalResponse writes initial — the primary response, sent as
+// soon as it's ready — followed by every patch delivered on patches, as a
+// multipart/mixed stream per the incremental-delivery spec. It returns once
+// patches is closed. Callers executing an operation with Incremental()
+// selections are expected to resolve each one in its own follow-up pass and
+// feed the result to patches as it completes, rather than buffering them.
+func WriteIncrementalResponse(
+	w http.ResponseWriter, initial json.RawMessage, patches <-chan IncrementalPatch,
+) error {
+	w.Header().Set("Content-Type", `multipart/mixed; boundary="`+incrementalBoundary+`"`)
+
+	mw := multipart.NewWriter(w)
+	if err := mw.SetBoundary(incrementalBoundary); err != nil {
+		return errors.Wrap(err, "while setting incremental-delivery boundary")
+	}
+
+	if err := writeIncrementalPart(mw, w, initial); err != nil {
+		return errors.Wrap(err, "while writing initial incremental-delivery part")
+	}
+
+	for patch := range patches {
+		data, err := json.Marshal(patch)
+		if err != nil {
+			return errors.Wrap(err, "while marshalling incremental-delivery patch")
+		}
+		if err := writeIncrementalPart(mw, w, data); err != nil {
+			return errors.Wrap(err, "while writing incremental-delivery patch")
+		}
+	}
+
+	return mw.Close()
+}
+
+// writeIncrementalPart writes data as one part of mw and flushes w, so the
+// client sees each patch as soon as it's produced instead of once the whole
+// response has been buffered.
+func writeIncrementalPart(mw *multipart.Writer, w http.ResponseWriter, data []byte) error {
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json"}})
+	if err != nil {
+		return err
+	}
+	if _, err := part.Write(data); err != nil {
+		return err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
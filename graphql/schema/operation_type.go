@@ -0,0 +1,67 @@
+/*
+ * Copyright 2019 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import "github.com/vektah/gqlparser/v2/ast"
+
+// OperationType classifies a GraphQL operation as a query, a mutation or a
+// subscription.
+type OperationType int
+
+const (
+	// QueryOperation marks an Operation as a GraphQL query.
+	QueryOperation OperationType = iota
+	// MutationOperation marks an Operation as a GraphQL mutation.
+	MutationOperation
+	// SubscriptionOperation marks an Operation as a GraphQL subscription.
+	// Subscription operations aren't resolved to a single response; instead
+	// they are handed to the websocket transport which keeps evaluating the
+	// operation and pushes a new result every time a watched predicate
+	// changes.
+	SubscriptionOperation
+)
+
+// OperationType tells whether op is a query, a mutation or a subscription.
+func (op *operation) OperationType() OperationType {
+	switch op.op.Operation {
+	case ast.Subscription:
+		return SubscriptionOperation
+	case ast.Mutation:
+		return MutationOperation
+	default:
+		return QueryOperation
+	}
+}
+
+// IsSubscription returns true if op is a GraphQL subscription.
+func (op *operation) IsSubscription() bool {
+	return op.OperationType() == SubscriptionOperation
+}
+
+// Typed is the part of Operation that lets a caller tell a query, a
+// mutation and a subscription apart. It's declared separately from the
+// rest of Operation's method set (see wrappers.go) so code that only needs
+// to dispatch on operation type — such as the HTTP handler choosing
+// between the regular query/mutation path and the websocket subscription
+// transport — can depend on it without the larger interface. Operation
+// doesn't embed Typed; *operation satisfies it via the two methods above.
+type Typed interface {
+	OperationType() OperationType
+	IsSubscription() bool
+}
+
+var _ Typed = (*operation)(nil)
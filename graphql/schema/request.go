@@ -17,6 +17,12 @@
 package schema
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"runtime"
+	"sync"
+	"unsafe"
+
 	"github.com/pkg/errors"
 
 	"github.com/vektah/gqlparser/v2/ast"
@@ -30,14 +36,108 @@ type Request struct {
 	Query         string                 `json:"query"`
 	OperationName string                 `json:"operationName"`
 	Variables     map[string]interface{} `json:"variables"`
+	Extensions    *Extensions            `json:"extensions,omitempty"`
+}
+
+// Extensions carries out-of-band GraphQL request metadata. Currently the
+// only extension understood here is Automatic Persisted Queries.
+type Extensions struct {
+	PersistedQuery *PersistedQuery `json:"persistedQuery,omitempty"`
+}
+
+// PersistedQuery identifies a query registered with the server via
+// Automatic Persisted Queries (APQ), so clients can send its hash instead of
+// the full query text on repeat requests.
+type PersistedQuery struct {
+	Sha256Hash string `json:"sha256Hash"`
+	Version    int    `json:"version"`
+}
+
+// PersistedQueryStore is the cache Automatic Persisted Queries are resolved
+// and registered against. It's pluggable so a deployment can back it with
+// whatever it already uses for caching, rather than dgraph mandating one.
+type PersistedQueryStore interface {
+	Get(hash string) (query string, ok bool)
+	Put(hash string, query string)
 }
 
+// persistedQueryStores holds the PersistedQueryStore installed on each
+// *schema, keyed by instance rather than kept as a single process-wide
+// global: the admin schema and the main schema are separate *schema
+// instances that can be live at once, and each needs its own APQ cache
+// rather than sharing (or clobbering) one another's. The key is s's address
+// rather than s itself, so the map doesn't keep s reachable.
+var (
+	persistedQueryStoresMu sync.RWMutex
+	persistedQueryStores   = map[uintptr]PersistedQueryStore{}
+)
+
+func persistedQueryStoreKey(s *schema) uintptr {
+	return uintptr(unsafe.Pointer(s))
+}
+
+// SetPersistedQueryStore installs the cache used to resolve and register
+// Automatic Persisted Queries for s. Passing nil disables APQ on s: a
+// request carrying only a hash then always gets PersistedQueryNotFound, and
+// a request carrying both a hash and its query is run without the hash
+// being checked or stored.
+//
+// A schema reload is routine in dgraph — the old *schema is discarded and a
+// new one takes its place — so the entry's lifetime is tied to s via a
+// finalizer rather than left to be cleaned up only by an explicit
+// SetPersistedQueryStore(s, nil), which nothing calls on reload; once s is
+// unreachable, its entry (and the store it points to) is freed too.
+func SetPersistedQueryStore(s *schema, store PersistedQueryStore) {
+	persistedQueryStoresMu.Lock()
+	defer persistedQueryStoresMu.Unlock()
+
+	key := persistedQueryStoreKey(s)
+	if store == nil {
+		delete(persistedQueryStores, key)
+		return
+	}
+
+	if _, tracked := persistedQueryStores[key]; !tracked {
+		runtime.SetFinalizer(s, func(s *schema) {
+			persistedQueryStoresMu.Lock()
+			delete(persistedQueryStores, persistedQueryStoreKey(s))
+			persistedQueryStoresMu.Unlock()
+		})
+	}
+	persistedQueryStores[key] = store
+}
+
+// persistedQueryStoreFor returns the PersistedQueryStore installed on s, or
+// nil if APQ hasn't been enabled for it.
+func persistedQueryStoreFor(s *schema) PersistedQueryStore {
+	persistedQueryStoresMu.RLock()
+	defer persistedQueryStoresMu.RUnlock()
+	return persistedQueryStores[persistedQueryStoreKey(s)]
+}
+
+// errPersistedQueryNotFound is returned verbatim, as required by the APQ
+// spec, so clients know to resend the query text alongside its hash.
+var errPersistedQueryNotFound = errors.New("PersistedQueryNotFound")
+
 // Operation finds the operation in req, if it is a valid request for GraphQL
 // schema s. If the request is GraphQL valid, it must contain a single valid
 // Operation.  If either the request is malformed or doesn't contain a valid
 // operation, all GraphQL errors encountered are returned.
+//
+// The returned Operation may be a query, a mutation or a subscription; use
+// OperationType() (see Typed) to tell them apart. Subscriptions aren't resolved to a
+// single result here — the caller is expected to hand them to the websocket
+// transport (see the subscription package), which re-evaluates the
+// operation and pushes a result each time a watched predicate changes.
 func (s *schema) Operation(req *Request) (Operation, error) {
-	if req == nil || req.Query == "" {
+	if req == nil {
+		return nil, errors.New("no query string supplied in request")
+	}
+
+	if err := resolvePersistedQuery(s, req); err != nil {
+		return nil, err
+	}
+	if req.Query == "" {
 		return nil, errors.New("no query string supplied in request")
 	}
 
@@ -46,6 +146,8 @@ func (s *schema) Operation(req *Request) (Operation, error) {
 		return nil, gqlErr
 	}
 
+	ensureIncrementalDirectives(s.schema)
+
 	listErr := validator.Validate(s.schema, doc)
 	if len(listErr) != 0 {
 		return nil, listErr
@@ -67,6 +169,15 @@ func (s *schema) Operation(req *Request) (Operation, error) {
 		return nil, gqlErr
 	}
 
+	// Custom rules (e.g. WithComplexityLimit) run after variables are
+	// resolved, so a rule inspecting an argument like `first: $n` sees its
+	// actual value rather than silently treating it as absent, and only
+	// against the operation this request selected, not every operation in
+	// the document.
+	if customErr := validateCustomRules(s.schema, doc, op, vars); len(customErr) != 0 {
+		return nil, customErr
+	}
+
 	operation := &operation{op: op,
 		vars:     vars,
 		query:    req.Query,
@@ -74,50 +185,46 @@ func (s *schema) Operation(req *Request) (Operation, error) {
 		inSchema: s,
 	}
 
-	// recursively expand fragments in operation as selection set fields
-	for _, s := range op.SelectionSet {
-		recursivelyExpandFragmentSelections(s.(*ast.Field), operation)
+	// expand fragments in operation as selection set fields
+	incremental, err := expandFragments(operation)
+	if err != nil {
+		return nil, err
 	}
 
-	return operation, nil
+	return withIncremental(operation, incremental), nil
 }
 
-// recursivelyExpandFragmentSelections puts a fragment's selection set directly inside this
-// field's selection set, and does it recursively for all the fields in this field's selection
-// set. This eventually expands all the fragment references anywhere in the hierarchy.
-func recursivelyExpandFragmentSelections(field *ast.Field, op *operation) {
-	// find all valid type names that this field satisfies
-	typeName := field.Definition.Type.Name()
-	satisfies := []string{typeName}
-	var additionalTypes []*ast.Definition
-	switch op.inSchema.schema.Types[typeName].Kind {
-	case ast.Interface:
-		additionalTypes = op.inSchema.schema.PossibleTypes[typeName]
-	case ast.Union:
-		additionalTypes = op.inSchema.schema.PossibleTypes[typeName]
-	case ast.Object:
-		additionalTypes = op.inSchema.schema.Implements[typeName]
-	default:
-		// return, as fragment can't be present on a field which is not Interface, Union or Object
-		return
+// resolvePersistedQuery implements Automatic Persisted Queries against s's
+// PersistedQueryStore: if req carries a persisted query hash and no query
+// text, it looks the hash up and fills in req.Query on a hit. If req
+// carries both a hash and query text, the query is verified against the
+// hash and then registered so future requests can send just the hash.
+func resolvePersistedQuery(s *schema, req *Request) error {
+	if req == nil || req.Extensions == nil || req.Extensions.PersistedQuery == nil {
+		return nil
 	}
-	for _, typ := range additionalTypes {
-		satisfies = append(satisfies, typ.Name)
+	pq := req.Extensions.PersistedQuery
+	store := persistedQueryStoreFor(s)
+
+	if req.Query == "" {
+		if store == nil {
+			return errPersistedQueryNotFound
+		}
+		query, ok := store.Get(pq.Sha256Hash)
+		if !ok {
+			return errPersistedQueryNotFound
+		}
+		req.Query = query
+		return nil
 	}
 
-	// collect all fields from any satisfying fragments into selectionSet
-	collectedFields := collectFields(&requestContext{
-		RawQuery:  op.query,
-		Variables: op.vars,
-		Doc:       op.doc,
-	}, field.SelectionSet, satisfies)
-	field.SelectionSet = make([]ast.Selection, 0, len(collectedFields))
-	for _, collectedField := range collectedFields {
-		field.SelectionSet = append(field.SelectionSet, collectedField.Field)
+	if store == nil {
+		return nil
 	}
-
-	// recursively run for this field's selectionSet
-	for _, f := range field.SelectionSet {
-		recursivelyExpandFragmentSelections(f.(*ast.Field), op)
+	sum := sha256.Sum256([]byte(req.Query))
+	if hex.EncodeToString(sum[:]) != pq.Sha256Hash {
+		return errors.New("provided sha does not match query")
 	}
+	store.Put(pq.Sha256Hash, req.Query)
+	return nil
 }
@@ -0,0 +1,61 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type mapPersistedQueryStore map[string]string
+
+func (m mapPersistedQueryStore) Get(hash string) (string, bool) { q, ok := m[hash]; return q, ok }
+func (m mapPersistedQueryStore) Put(hash string, query string)  { m[hash] = query }
+
+// TestPersistedQueryStoreEntryIsReleasedOnSchemaReload exercises the
+// finalizer-based cleanup: once a *schema that had an APQ store installed
+// becomes unreachable (as happens on every schema reload, since the old
+// *schema is simply discarded), its persistedQueryStores entry must not
+// survive it.
+func TestPersistedQueryStoreEntryIsReleasedOnSchemaReload(t *testing.T) {
+	func() {
+		s := &schema{schema: complexityTestSchema}
+		SetPersistedQueryStore(s, mapPersistedQueryStore{})
+		require.NotNil(t, persistedQueryStoreFor(s))
+		// s goes out of scope here with nothing else referencing it, the
+		// same as the old *schema after a reload.
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+
+		persistedQueryStoresMu.Lock()
+		n := len(persistedQueryStores)
+		persistedQueryStoresMu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("persistedQueryStores still holds %d entries after the owning schema was collected", n)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/gqlerror"
+)
+
+// ValidationRule is a user-supplied check run against the operation a
+// request selected, after it has passed gqlparser's own validator.Validate
+// but before it reaches the resolver layer. doc is the whole parsed
+// document, needed to look up fragment definitions op's selection set
+// spreads; vars holds the request's variables, already resolved against op,
+// so a rule can price an argument like `first: $n` by its actual value
+// rather than only ever seeing literals. It reports any violations as
+// GraphQL errors.
+type ValidationRule interface {
+	Validate(
+		s *ast.Schema, doc *ast.QueryDocument, op *ast.OperationDefinition,
+		vars map[string]interface{},
+	) gqlerror.List
+}
+
+// ValidationRuleFunc adapts a plain function to a ValidationRule.
+type ValidationRuleFunc func(
+	s *ast.Schema, doc *ast.QueryDocument, op *ast.OperationDefinition,
+	vars map[string]interface{},
+) gqlerror.List
+
+// Validate calls f.
+func (f ValidationRuleFunc) Validate(
+	s *ast.Schema, doc *ast.QueryDocument, op *ast.OperationDefinition,
+	vars map[string]interface{},
+) gqlerror.List {
+	return f(s, doc, op, vars)
+}
+
+// customValidationRules are run, in registration order, on every operation
+// built by Operation(), in addition to gqlparser's own validator.Validate.
+var customValidationRules []ValidationRule
+
+// RegisterValidationRule adds rule to the set run on every operation. Rules
+// are cumulative and run in the order they were registered; the first rule
+// to report an error stops the operation from being built.
+func RegisterValidationRule(rule ValidationRule) {
+	customValidationRules = append(customValidationRules, rule)
+}
+
+// validateCustomRules runs customValidationRules against op, the operation a
+// request selected out of doc, with vars already resolved against it,
+// returning the errors from the first rule that reports any.
+func validateCustomRules(
+	s *ast.Schema, doc *ast.QueryDocument, op *ast.OperationDefinition,
+	vars map[string]interface{},
+) gqlerror.List {
+	for _, rule := range customValidationRules {
+		if errs := rule.Validate(s, doc, op, vars); len(errs) != 0 {
+			return errs
+		}
+	}
+	return nil
+}
+
+// complexityRule is the built-in ValidationRule returned by
+// WithComplexityLimit.
+type complexityRule struct {
+	limit int
+}
+
+// WithComplexityLimit builds a ValidationRule that rejects any operation
+// whose estimated complexity exceeds limit. A field costs 1 plus the cost of
+// its own selection set; a list field's cost is multiplied by its `first`
+// or `limit` argument, so a deeply nested query over large lists is priced
+// the way it would actually execute. Register the result with
+// RegisterValidationRule to have it run on every request.
+func WithComplexityLimit(limit int) ValidationRule {
+	return &complexityRule{limit: limit}
+}
+
+func (c *complexityRule) Validate(
+	s *ast.Schema, doc *ast.QueryDocument, op *ast.OperationDefinition,
+	vars map[string]interface{},
+) gqlerror.List {
+	// Only the operation a request actually selected gets scored: a sibling
+	// operation in the same document that's never executed shouldn't reject
+	// a cheap query, and vars is only resolved against op anyway.
+	cost := selectionSetComplexity(op.SelectionSet, doc, vars)
+	if cost <= c.limit {
+		return nil
+	}
+	return gqlerror.List{gqlerror.ErrorPosf(op.Position,
+		"operation %s has complexity %d, which exceeds the limit of %d",
+		op.Name, cost, c.limit)}
+}
+
+// selectionSetComplexity estimates the cost of evaluating set: each field
+// costs 1 plus the cost of its own selection set, multiplied by the field's
+// first/limit argument when it selects a list. vars resolves any of those
+// arguments passed as a GraphQL variable rather than a literal. A fragment
+// spread or inline fragment in set isn't itself priced; its own selection
+// set is looked up (via doc.Fragments for a spread) and recursed into, so
+// wrapping the expensive part of a query in a fragment can't zero out its
+// cost.
+func selectionSetComplexity(set ast.SelectionSet, doc *ast.QueryDocument, vars map[string]interface{}) int {
+	total := 0
+	for _, sel := range set {
+		switch s := sel.(type) {
+		case *ast.Field:
+			total += listMultiplier(s, vars) * (1 + selectionSetComplexity(s.SelectionSet, doc, vars))
+		case *ast.FragmentSpread:
+			if def := doc.Fragments.ForName(s.Name); def != nil {
+				total += selectionSetComplexity(def.SelectionSet, doc, vars)
+			}
+		case *ast.InlineFragment:
+			total += selectionSetComplexity(s.SelectionSet, doc, vars)
+		}
+	}
+	return total
+}
+
+// listMultiplier returns the first/limit argument of field if it selects a
+// list, or 1 if the field isn't a list or carries neither argument. vars
+// resolves the argument when it's passed as a variable instead of a
+// literal, so pricing can't be dodged by moving `first`/`limit` into one.
+func listMultiplier(field *ast.Field, vars map[string]interface{}) int {
+	if field.Definition == nil || field.Definition.Type.Elem == nil {
+		return 1
+	}
+	for _, argName := range []string{"first", "limit"} {
+		arg := field.Arguments.ForName(argName)
+		if arg == nil {
+			continue
+		}
+		val, err := arg.Value.Value(vars)
+		if err != nil {
+			continue
+		}
+		n, ok := asInt(val)
+		if ok && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// asInt normalizes the value produced by resolving an argument, which comes
+// back as int64 for a literal but as whatever JSON-decoded numeric type the
+// variable carried (typically float64) when resolved through vars.
+func asInt(val interface{}) (int, bool) {
+	switch n := val.(type) {
+	case int64:
+		return int(n), true
+	case int:
+		return n, true
+	case float64:
+		return int(n), true
+	default:
+		return 0, false
+	}
+}
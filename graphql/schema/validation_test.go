@@ -0,0 +1,135 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package schema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/vektah/gqlparser/v2"
+	"github.com/vektah/gqlparser/v2/ast"
+	"github.com/vektah/gqlparser/v2/parser"
+	"github.com/vektah/gqlparser/v2/validator"
+)
+
+var complexityTestSchema = gqlparser.MustLoadSchema(&ast.Source{Input: `
+	type Query {
+		users(first: Int): [User]
+	}
+
+	type User {
+		name: String
+		friends(first: Int): [User]
+	}
+`})
+
+// complexity runs selectionSetComplexity on query, resolving vars against it
+// exactly the way Operation() does, so the test exercises the same path a
+// real request would.
+func complexity(t *testing.T, query string, vars map[string]interface{}) int {
+	doc, gqlErr := parser.ParseQuery(&ast.Source{Input: query})
+	require.Nil(t, gqlErr)
+	require.Empty(t, validator.Validate(complexityTestSchema, doc))
+
+	op := doc.Operations[0]
+	resolved, gqlErr := validator.VariableValues(complexityTestSchema, op, vars)
+	require.Nil(t, gqlErr)
+
+	return selectionSetComplexity(op.SelectionSet, doc, resolved)
+}
+
+func TestListMultiplierLiteral(t *testing.T) {
+	cost := complexity(t, `{ users(first: 5) { name } }`, nil)
+	require.Equal(t, 5*2, cost)
+}
+
+func TestListMultiplierVariable(t *testing.T) {
+	cost := complexity(t,
+		`query($n: Int) { users(first: $n) { name } }`,
+		map[string]interface{}{"n": 5})
+	require.Equal(t, 5*2, cost)
+}
+
+func TestListMultiplierNestedVariable(t *testing.T) {
+	cost := complexity(t,
+		`query($n: Int) { users(first: $n) { friends(first: $n) { name } } }`,
+		map[string]interface{}{"n": 3})
+	// users: 3 * (1 + friends: 3 * (1 + name: 1))
+	require.Equal(t, 3*(1+3*(1+1)), cost)
+}
+
+func TestWithComplexityLimitRejectsOverVariable(t *testing.T) {
+	doc, gqlErr := parser.ParseQuery(&ast.Source{Input: `query($n: Int) { users(first: $n) { name } }`})
+	require.Nil(t, gqlErr)
+	require.Empty(t, validator.Validate(complexityTestSchema, doc))
+
+	op := doc.Operations[0]
+	vars, gqlErr := validator.VariableValues(complexityTestSchema, op, map[string]interface{}{"n": 100})
+	require.Nil(t, gqlErr)
+
+	rule := WithComplexityLimit(10)
+	errs := rule.Validate(complexityTestSchema, doc, op, vars)
+	require.NotEmpty(t, errs, "a first passed as a variable must still be priced")
+}
+
+func TestWithComplexityLimitAllowsUnderVariable(t *testing.T) {
+	doc, gqlErr := parser.ParseQuery(&ast.Source{Input: `query($n: Int) { users(first: $n) { name } }`})
+	require.Nil(t, gqlErr)
+	require.Empty(t, validator.Validate(complexityTestSchema, doc))
+
+	op := doc.Operations[0]
+	vars, gqlErr := validator.VariableValues(complexityTestSchema, op, map[string]interface{}{"n": 1})
+	require.Nil(t, gqlErr)
+
+	rule := WithComplexityLimit(10)
+	errs := rule.Validate(complexityTestSchema, doc, op, vars)
+	require.Empty(t, errs)
+}
+
+func TestComplexityScoresSelectedOperationOnly(t *testing.T) {
+	doc, gqlErr := parser.ParseQuery(&ast.Source{Input: `
+		query Cheap { users(first: 1) { name } }
+		query Expensive { users(first: 999999) { name } }
+	`})
+	require.Nil(t, gqlErr)
+	require.Empty(t, validator.Validate(complexityTestSchema, doc))
+
+	op := doc.Operations.ForName("Cheap")
+	vars, gqlErr := validator.VariableValues(complexityTestSchema, op, nil)
+	require.Nil(t, gqlErr)
+
+	rule := WithComplexityLimit(10)
+	errs := rule.Validate(complexityTestSchema, doc, op, vars)
+	require.Empty(t, errs, "an expensive sibling operation that isn't selected must not be scored")
+}
+
+func TestComplexityRecursesIntoFragments(t *testing.T) {
+	doc, gqlErr := parser.ParseQuery(&ast.Source{Input: `
+		fragment F on Query { users(first: 999999) { name } }
+		{ ...F }
+	`})
+	require.Nil(t, gqlErr)
+	require.Empty(t, validator.Validate(complexityTestSchema, doc))
+
+	op := doc.Operations[0]
+	vars, gqlErr := validator.VariableValues(complexityTestSchema, op, nil)
+	require.Nil(t, gqlErr)
+
+	rule := WithComplexityLimit(10)
+	errs := rule.Validate(complexityTestSchema, doc, op, vars)
+	require.NotEmpty(t, errs, "wrapping the expensive selection in a fragment must not zero its cost")
+}
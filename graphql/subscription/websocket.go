@@ -0,0 +1,279 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package subscription implements the websocket transport that serves
+// GraphQL subscriptions, speaking the graphql-ws protocol used by Apollo
+// and graphql-ws clients.
+package subscription
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+
+	"github.com/dgraph-io/dgraph/graphql/schema"
+)
+
+// Sub-protocols understood by the handler. Older clients speak graphql-ws,
+// newer ones speak graphql-transport-ws; both are accepted so we don't break
+// existing tooling while rolling out the newer protocol.
+const (
+	protocolGraphQLWS          = "graphql-ws"
+	protocolGraphQLTransportWS = "graphql-transport-ws"
+)
+
+// messageType is the `type` field of a graphql-ws protocol message.
+type messageType string
+
+const (
+	connectionInit      messageType = "connection_init"
+	connectionAck       messageType = "connection_ack"
+	connectionTerminate messageType = "connection_terminate"
+	start               messageType = "start"
+	subscribe           messageType = "subscribe"
+	data                messageType = "data"
+	next                messageType = "next"
+	errorMsg            messageType = "error"
+	complete            messageType = "complete"
+	stop                messageType = "stop"
+)
+
+// operationMessage is the envelope every graphql-ws protocol message is sent
+// and received in.
+type operationMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    messageType     `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// Resolver executes a subscription operation and reports every update it
+// produces. It's implemented by the resolve package; kept as an interface
+// here so the transport doesn't need to depend on query execution.
+type Resolver interface {
+	// Resolve evaluates op once, returning the current result for it.
+	Resolve(op schema.Operation) (json.RawMessage, error)
+	// Poll returns the interval this subscription should be re-evaluated
+	// at; a return of 0 means "notify on change" rather than poll.
+	Poll() time.Duration
+}
+
+// ChangeNotifier is implemented by a Resolver whose Poll reports 0 ("notify
+// on change"): instead of being re-evaluated on a fixed interval, it's
+// re-evaluated every time Changed fires, which is how subscriptions watch a
+// predicate rather than paying the cost of re-resolving on a timer.
+type ChangeNotifier interface {
+	// Changed is sent to whenever the data underlying the subscription may
+	// have changed and it should be re-resolved.
+	Changed() <-chan struct{}
+}
+
+// Upgrader builds the websocket.Upgrader used to accept subscription
+// connections; subprotocols are negotiated from the two graphql-ws variants
+// we support.
+var Upgrader = websocket.Upgrader{
+	Subprotocols: []string{protocolGraphQLWS, protocolGraphQLTransportWS},
+	CheckOrigin:  func(r *http.Request) bool { return true },
+}
+
+// ResolverFor parses and validates a subscription request against the
+// in-scope GraphQL schema and returns a Resolver that keeps it up to date.
+// It's implemented by the caller (which has the schema in scope) so this
+// package has no dependency on how operations are parsed or evaluated.
+type ResolverFor func(req *schema.Request) (schema.Operation, Resolver, error)
+
+// conn tracks the lifecycle of one websocket connection and the set of
+// subscriptions active on it, keyed by the client-supplied operation id.
+type conn struct {
+	ws *websocket.Conn
+
+	mu   sync.Mutex
+	subs map[string]chan struct{} // id -> stop channel
+
+	resolverFor ResolverFor
+}
+
+// Handler adapts Serve to an http.Handler so the subscription transport can
+// be mounted directly on the same route the admin HTTP handler serves
+// queries and mutations from, e.g. by checking for a websocket upgrade
+// request before falling through to the regular GraphQL handler.
+func Handler(resolverFor ResolverFor) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := Serve(w, r, resolverFor); err != nil {
+			glog.Errorf("subscription: %v", err)
+		}
+	})
+}
+
+// Serve upgrades r into a websocket and runs the graphql-ws protocol on it
+// until the client disconnects.
+func Serve(w http.ResponseWriter, r *http.Request, resolverFor ResolverFor) error {
+
+	ws, err := Upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return errors.Wrap(err, "while upgrading to websocket")
+	}
+
+	c := &conn{
+		ws:          ws,
+		subs:        make(map[string]chan struct{}),
+		resolverFor: resolverFor,
+	}
+	defer c.closeAll()
+
+	for {
+		var msg operationMessage
+		if err := ws.ReadJSON(&msg); err != nil {
+			return errors.Wrap(err, "while reading subscription message")
+		}
+
+		switch msg.Type {
+		case connectionInit:
+			c.send(operationMessage{Type: connectionAck})
+		case start, subscribe:
+			c.handleStart(msg)
+		case stop, complete, connectionTerminate:
+			// stop is the graphql-ws unsubscribe message; complete is its
+			// graphql-transport-ws equivalent.
+			c.handleStop(msg.ID)
+			if msg.Type == connectionTerminate {
+				return nil
+			}
+		default:
+			glog.Warningf("subscription: ignoring unknown message type %q", msg.Type)
+		}
+	}
+}
+
+func (c *conn) handleStart(msg operationMessage) {
+	var req schema.Request
+	if err := json.Unmarshal(msg.Payload, &req); err != nil {
+		c.sendError(msg.ID, errors.Wrap(err, "invalid subscription payload"))
+		return
+	}
+
+	stopCh := make(chan struct{})
+	c.mu.Lock()
+	c.subs[msg.ID] = stopCh
+	c.mu.Unlock()
+
+	go c.run(msg.ID, &req, stopCh)
+}
+
+func (c *conn) handleStop(id string) {
+	c.mu.Lock()
+	stopCh, ok := c.subs[id]
+	delete(c.subs, id)
+	c.mu.Unlock()
+
+	if ok {
+		close(stopCh)
+	}
+}
+
+func (c *conn) closeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, stopCh := range c.subs {
+		close(stopCh)
+		delete(c.subs, id)
+	}
+	c.ws.Close()
+}
+
+// run evaluates the subscription named by id until stopCh is closed, pushing
+// a data message every time the resolver reports a new result. If resolver
+// reports Poll() <= 0 and also implements ChangeNotifier, it's re-resolved
+// on Changed() instead of on a timer; otherwise it falls back to polling.
+func (c *conn) run(id string, req *schema.Request, stopCh chan struct{}) {
+	op, resolver, err := c.resolverFor(req)
+	if err != nil {
+		c.sendError(id, err)
+		c.handleStop(id)
+		return
+	}
+
+	if interval := resolver.Poll(); interval > 0 {
+		c.poll(id, op, resolver, interval, stopCh)
+		return
+	}
+
+	notifier, ok := resolver.(ChangeNotifier)
+	if !ok {
+		glog.Warningf("subscription: resolver for %q reports Poll() <= 0 but doesn't "+
+			"implement ChangeNotifier; falling back to polling every second", id)
+		c.poll(id, op, resolver, time.Second, stopCh)
+		return
+	}
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-notifier.Changed():
+			c.resolveAndSend(id, op, resolver)
+		}
+	}
+}
+
+// poll re-resolves op on every tick of interval until stopCh is closed.
+func (c *conn) poll(
+	id string, op schema.Operation, resolver Resolver, interval time.Duration, stopCh chan struct{},
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+			c.resolveAndSend(id, op, resolver)
+		}
+	}
+}
+
+// resolveAndSend resolves op and pushes the result (or an error) to id.
+func (c *conn) resolveAndSend(id string, op schema.Operation, resolver Resolver) {
+	result, err := resolver.Resolve(op)
+	if err != nil {
+		c.sendError(id, err)
+		return
+	}
+	// graphql-ws clients expect "data"; graphql-transport-ws clients "next".
+	typ := next
+	if c.ws.Subprotocol() == protocolGraphQLWS {
+		typ = data
+	}
+	c.send(operationMessage{ID: id, Type: typ, Payload: result})
+}
+
+func (c *conn) send(msg operationMessage) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.ws.WriteJSON(msg); err != nil {
+		glog.Errorf("subscription: couldn't write message: %v", err)
+	}
+}
+
+func (c *conn) sendError(id string, err error) {
+	payload, _ := json.Marshal(map[string]string{"message": err.Error()})
+	c.send(operationMessage{ID: id, Type: errorMsg, Payload: payload})
+}
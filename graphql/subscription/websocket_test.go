@@ -0,0 +1,85 @@
+/*
+ * Copyright 2021 Dgraph Labs, Inc. and Contributors
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package subscription
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dgraph-io/dgraph/graphql/schema"
+)
+
+// pollResolver is a minimal Resolver that re-resolves on a fast, fixed
+// interval so tests don't have to wait out a realistic poll period.
+type pollResolver struct{}
+
+func (pollResolver) Resolve(schema.Operation) (json.RawMessage, error) {
+	return json.RawMessage(`{"value":1}`), nil
+}
+func (pollResolver) Poll() time.Duration { return 5 * time.Millisecond }
+
+func dialSubscription(t *testing.T, srv *httptest.Server, protocol string) *websocket.Conn {
+	t.Helper()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	header := map[string][]string{"Sec-WebSocket-Protocol": {protocol}}
+	conn, _, err := websocket.DefaultDialer.Dial(url, header)
+	require.NoError(t, err)
+	return conn
+}
+
+func TestCompleteMessageStopsSubscription(t *testing.T) {
+	resolverFor := func(req *schema.Request) (schema.Operation, Resolver, error) {
+		return nil, pollResolver{}, nil
+	}
+
+	srv := httptest.NewServer(Handler(resolverFor))
+	defer srv.Close()
+
+	conn := dialSubscription(t, srv, protocolGraphQLTransportWS)
+	defer conn.Close()
+
+	require.NoError(t, conn.WriteJSON(operationMessage{Type: connectionInit}))
+	var ack operationMessage
+	require.NoError(t, conn.ReadJSON(&ack))
+	require.Equal(t, connectionAck, ack.Type)
+
+	require.NoError(t, conn.WriteJSON(operationMessage{ID: "1", Type: subscribe, Payload: json.RawMessage(`{}`)}))
+
+	var msg operationMessage
+	require.NoError(t, conn.ReadJSON(&msg))
+	require.Equal(t, next, msg.Type)
+
+	// graphql-transport-ws clients unsubscribe with "complete", not "stop".
+	require.NoError(t, conn.WriteJSON(operationMessage{ID: "1", Type: complete}))
+
+	// The subscription's goroutine should stop pushing updates for id "1"
+	// once complete is handled; give it a moment, then make sure nothing
+	// else with that id shows up.
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+	for {
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		require.NotEqual(t, "1", msg.ID, "subscription kept running after a complete message")
+	}
+}